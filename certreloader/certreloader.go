@@ -0,0 +1,161 @@
+// Copyright (c) 2018 Zededa, Inc.
+// All rights reserved.
+
+// Package certreloader watches a device's identity directory for changes
+// to its certificate, key, root certificate and server files and rebuilds
+// the TLS config used to talk to the controller, without requiring the
+// agent to restart. This matters during controller re-homing and cert
+// rotation, where previously the only remedy was to kill and restart
+// zedclient.
+package certreloader
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/zededa/go-provision/zedcloud"
+)
+
+// Reloader watches certFile/keyFile/serverFile (all expected to live in
+// dir, alongside root-certificate.pem) and keeps an up to date TlsConfig
+// and server address available via TLSConfig/ServerNameAndPort. Callers
+// read those atomically; there is no locking involved.
+type Reloader struct {
+	dir        string
+	certFile   string
+	keyFile    string
+	serverFile string
+
+	tlsConfig  atomic.Value // *tls.Config
+	serverAddr atomic.Value // string, host:port
+
+	watcher       *fsnotify.Watcher
+	serverChanged chan struct{}
+}
+
+// New creates a Reloader, performing an initial synchronous load of
+// certFile/keyFile/serverFile so that callers have a usable TlsConfig
+// before Watch is started.
+func New(dir, certFile, keyFile, serverFile string) (*Reloader, error) {
+	r := &Reloader{
+		dir:           dir,
+		certFile:      certFile,
+		keyFile:       keyFile,
+		serverFile:    serverFile,
+		serverChanged: make(chan struct{}, 1),
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("certreloader: failed to create watcher: %v", err)
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("certreloader: failed to watch %s: %v", dir, err)
+	}
+	r.watcher = watcher
+	return r, nil
+}
+
+// watchedBasenames are the files under dir whose changes should trigger a
+// reload of the TLS config.
+var watchedBasenames = map[string]bool{
+	"device.cert.pem":      true,
+	"device.key.pem":       true,
+	"onboard.cert.pem":     true,
+	"onboard.key.pem":      true,
+	"root-certificate.pem": true,
+	"server":               true,
+}
+
+// Watch runs until the Reloader is closed, reloading the TLS config
+// whenever one of the watched files changes.
+func (r *Reloader) Watch() {
+	for {
+		select {
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if !watchedBasenames[filepath.Base(event.Name)] {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			log.Infof("certreloader: %s changed; reloading\n", event.Name)
+			if err := r.reload(); err != nil {
+				log.Errorf("certreloader: reload failed: %v\n", err)
+			}
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("certreloader: watcher error: %v\n", err)
+		}
+	}
+}
+
+// Close stops the underlying fsnotify watcher.
+func (r *Reloader) Close() error {
+	return r.watcher.Close()
+}
+
+// reload re-reads certFile/keyFile/serverFile, rebuilds the TLS config via
+// zedcloud.GetTlsConfig and atomically swaps it in. If serverFile's
+// contents changed since the last load, it also signals ServerChanged.
+func (r *Reloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("certreloader: failed to load %s/%s: %v",
+			r.certFile, r.keyFile, err)
+	}
+	serverBytes, err := ioutil.ReadFile(r.serverFile)
+	if err != nil {
+		return fmt.Errorf("certreloader: failed to read %s: %v",
+			r.serverFile, err)
+	}
+	serverNameAndPort := strings.TrimSpace(string(serverBytes))
+	serverName := strings.Split(serverNameAndPort, ":")[0]
+
+	tlsConfig, err := zedcloud.GetTlsConfig(serverName, &cert)
+	if err != nil {
+		return fmt.Errorf("certreloader: GetTlsConfig failed: %v", err)
+	}
+
+	oldAddr, _ := r.serverAddr.Load().(string)
+	r.tlsConfig.Store(tlsConfig)
+	r.serverAddr.Store(serverNameAndPort)
+	if oldAddr != "" && oldAddr != serverNameAndPort {
+		select {
+		case r.serverChanged <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// TLSConfig returns the most recently loaded *tls.Config.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return r.tlsConfig.Load().(*tls.Config)
+}
+
+// ServerNameAndPort returns the most recently loaded "host:port" contents
+// of the server file.
+func (r *Reloader) ServerNameAndPort() string {
+	return r.serverAddr.Load().(string)
+}
+
+// ServerChanged fires whenever the server file's contents change, so that
+// in-flight retry loops can restart their backoff against the new address.
+func (r *Reloader) ServerChanged() <-chan struct{} {
+	return r.serverChanged
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2018 Zededa, Inc.
+// All rights reserved.
+
+package certreloader
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/zededa/go-provision/devicecert"
+)
+
+// writeTestServerFile is a small helper since every case below needs a
+// "server" file alongside the generated device cert/key.
+func writeTestServerFile(t *testing.T, dir, addr string) {
+	t.Helper()
+	if err := ioutil.WriteFile(dir+"/server", []byte(addr+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write server file: %v", err)
+	}
+}
+
+func TestNewLoadsInitialTlsConfigAndServerAddr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certreloader")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, _, err := devicecert.EnsureKeyPair(dir, devicecert.CertOpts{CommonName: "unit-test"}); err != nil {
+		t.Fatalf("EnsureKeyPair failed: %v", err)
+	}
+	writeTestServerFile(t, dir, "zedcloud.example.com:4433")
+
+	r, err := New(dir, dir+"/device.cert.pem", dir+"/device.key.pem", dir+"/server")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer r.Close()
+
+	if r.TLSConfig() == nil {
+		t.Fatal("expected a non-nil TlsConfig after initial load")
+	}
+	if got := r.ServerNameAndPort(); got != "zedcloud.example.com:4433" {
+		t.Fatalf("ServerNameAndPort() = %q, want %q", got, "zedcloud.example.com:4433")
+	}
+}
+
+func TestReloadSignalsServerChangedOnAddrChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certreloader")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, _, err := devicecert.EnsureKeyPair(dir, devicecert.CertOpts{CommonName: "unit-test"}); err != nil {
+		t.Fatalf("EnsureKeyPair failed: %v", err)
+	}
+	writeTestServerFile(t, dir, "old.example.com:4433")
+
+	r, err := New(dir, dir+"/device.cert.pem", dir+"/device.key.pem", dir+"/server")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer r.Close()
+
+	select {
+	case <-r.ServerChanged():
+		t.Fatal("ServerChanged fired before any change was made")
+	default:
+	}
+
+	writeTestServerFile(t, dir, "new.example.com:4433")
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	select {
+	case <-r.ServerChanged():
+	default:
+		t.Fatal("expected ServerChanged to fire after the server file changed")
+	}
+	if got := r.ServerNameAndPort(); got != "new.example.com:4433" {
+		t.Fatalf("ServerNameAndPort() = %q, want %q", got, "new.example.com:4433")
+	}
+}
+
+func TestReloadDoesNotSignalServerChangedWhenAddrIsUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certreloader")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, _, err := devicecert.EnsureKeyPair(dir, devicecert.CertOpts{CommonName: "unit-test"}); err != nil {
+		t.Fatalf("EnsureKeyPair failed: %v", err)
+	}
+	writeTestServerFile(t, dir, "same.example.com:4433")
+
+	r, err := New(dir, dir+"/device.cert.pem", dir+"/device.key.pem", dir+"/server")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer r.Close()
+
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	select {
+	case <-r.ServerChanged():
+		t.Fatal("ServerChanged fired even though the server address did not change")
+	default:
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2018 Zededa, Inc.
+// All rights reserved.
+
+package client
+
+import (
+	"math/rand"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BackoffPolicy bounds the exponential backoff used by runWithBackoff. A
+// zero value for MaxAttempts or Deadline means that dimension is unbounded.
+type BackoffPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Jitter       time.Duration
+	MaxAttempts  int
+	Deadline     time.Duration
+}
+
+// runWithBackoff calls op(attempt) with exponential backoff, starting at
+// attempt 0, until op returns true. name is used only for log messages.
+//
+// If reset fires between attempts, the backoff state is discarded and
+// restarted from attempt 0 with the initial delay; this is used to make
+// in-flight retry loops pick up a new server address immediately instead of
+// waiting out whatever delay they had accumulated against the old one. A
+// nil reset channel disables this behavior.
+//
+// If policy.MaxAttempts is exceeded the process exits with status 1, as
+// zedclient has always done when retries are exhausted. If policy.Deadline
+// is non-zero and the wall-clock time since the first attempt plus the next
+// sleep would exceed it, the process exits with status 3 instead; this lets
+// operators bound total boot time independently of the attempt count.
+func runWithBackoff(name string, policy BackoffPolicy, reset <-chan struct{}, op func(attempt int) bool) {
+	start := time.Now()
+	attempt := 0
+	delay := policy.InitialDelay
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-reset:
+			timer.Stop()
+			log.Infof("%s: server changed, restarting backoff\n", name)
+			attempt = 0
+			delay = policy.InitialDelay
+			start = time.Now()
+			continue
+		}
+		if op(attempt) {
+			return
+		}
+		attempt++
+		if policy.MaxAttempts != 0 && attempt > policy.MaxAttempts {
+			log.Errorf("Exceeded %d retries for %s\n",
+				policy.MaxAttempts, name)
+			os.Exit(1)
+		}
+		delay = 2 * (delay + time.Second)
+		if policy.Jitter != 0 {
+			delay += time.Duration(rand.Int63n(int64(policy.Jitter)))
+		}
+		if policy.MaxDelay != 0 && delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+		if policy.Deadline != 0 {
+			elapsed := time.Since(start)
+			if elapsed+delay > policy.Deadline {
+				log.Errorf("%s timed out after %s against a %s retry-timeout\n",
+					name, elapsed, policy.Deadline)
+				os.Exit(3)
+			}
+		}
+		sharedLogState.setNextDelayMs(durationMs(delay))
+		fields := eventFields(name, "", attempt, 0, time.Since(start))
+		log.WithFields(fields).Infof("Retrying %s in %d seconds\n", name, delay/time.Second)
+	}
+}
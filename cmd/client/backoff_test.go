@@ -0,0 +1,70 @@
+// Copyright (c) 2018 Zededa, Inc.
+// All rights reserved.
+
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunWithBackoffSucceedsImmediately(t *testing.T) {
+	policy := BackoffPolicy{InitialDelay: time.Millisecond}
+	calls := 0
+	runWithBackoff("test", policy, nil, func(attempt int) bool {
+		calls++
+		if attempt != 0 {
+			t.Errorf("expected first attempt to be 0, got %d", attempt)
+		}
+		return true
+	})
+	if calls != 1 {
+		t.Errorf("expected op to be called once, got %d", calls)
+	}
+}
+
+func TestRunWithBackoffRetriesThenSucceeds(t *testing.T) {
+	policy := BackoffPolicy{InitialDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	var attempts []int
+	runWithBackoff("test", policy, nil, func(attempt int) bool {
+		attempts = append(attempts, attempt)
+		return attempt == 2
+	})
+	want := []int{0, 1, 2}
+	if len(attempts) != len(want) {
+		t.Fatalf("got attempts %v, want %v", attempts, want)
+	}
+	for i := range want {
+		if attempts[i] != want[i] {
+			t.Fatalf("got attempts %v, want %v", attempts, want)
+		}
+	}
+}
+
+func TestRunWithBackoffResetRestartsAttemptCount(t *testing.T) {
+	policy := BackoffPolicy{InitialDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	reset := make(chan struct{}, 1)
+	var attempts []int
+	triggeredReset := false
+	runWithBackoff("test", policy, reset, func(attempt int) bool {
+		attempts = append(attempts, attempt)
+		if attempt == 2 && !triggeredReset {
+			triggeredReset = true
+			reset <- struct{}{}
+			return false
+		}
+		return attempt == 1 && triggeredReset
+	})
+	// Without the reset, the sequence would be 0,1,2,3,...; with it firing
+	// once attempt 2 is seen, attempt must drop back to 0 before climbing
+	// again to the 1 that ends the loop.
+	foundResetDip := false
+	for i := 1; i < len(attempts); i++ {
+		if attempts[i-1] == 2 && attempts[i] == 0 {
+			foundResetDip = true
+		}
+	}
+	if !foundResetDip {
+		t.Fatalf("expected attempt count to drop back to 0 after reset, got %v", attempts)
+	}
+}
@@ -5,7 +5,6 @@ package client
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/base64"
 	"flag"
 	"fmt"
@@ -16,12 +15,13 @@ import (
 	"github.com/zededa/api/zmet"
 	"github.com/zededa/go-provision/agentlog"
 	"github.com/zededa/go-provision/cast"
+	"github.com/zededa/go-provision/certreloader"
+	"github.com/zededa/go-provision/devicecert"
 	"github.com/zededa/go-provision/devicenetwork"
 	"github.com/zededa/go-provision/pidfile"
 	"github.com/zededa/go-provision/pubsub"
 	"github.com/zededa/go-provision/types"
 	"github.com/zededa/go-provision/zedcloud"
-	"io"
 	"io/ioutil"
 	"mime"
 	"net/http"
@@ -50,8 +50,18 @@ var Version = "No version specified"
 //  onboard.cert.pem, onboard.key.pem	Per device onboarding certificate/key
 //  		   		for selfRegister operation
 //  device.cert.pem,
-//  device.key.pem		Device certificate/key created before this
-//  		     		client is started.
+//  device.key.pem		Device certificate/key. Created before this
+//  		     		client is started, or self-generated by
+//  		     		EnsureKeyPair below if absent or -generate
+//  		     		is given.
+//  deviceid			Written alongside uuid; fingerprint of
+//  				device.cert.pem. NOT YET sent to the
+//  				controller: zmet.ZRegisterMsg has no field
+//  				for it today, so trust-on-first-use pinning
+//  				from this value is blocked on that proto
+//  				change landing in github.com/zededa/api.
+//  				Until then this is local-only, for operator
+//  				debugging and future use.
 //  uuid			Written by getUuid operation
 //  hardwaremodel		Written by getUuid if server returns a hardwaremodel
 //
@@ -62,6 +72,7 @@ type clientContext struct {
 	deviceNetworkStatus    *types.DeviceNetworkStatus
 	usableAddressCount     int
 	subGlobalConfig        *pubsub.Subscription
+	metrics                *clientMetrics
 }
 
 var debug = false
@@ -75,6 +86,16 @@ func Run() {
 	stdoutPtr := flag.Bool("s", false, "Use stdout instead of console")
 	noPidPtr := flag.Bool("p", false, "Do not check for running client")
 	maxRetriesPtr := flag.Int("r", 0, "Max ping retries")
+	generatePtr := flag.Bool("generate", false, "Force (re)generation of device cert/key")
+	metricsListenPtr := flag.String("metrics-listen", "", "Address to serve Prometheus metrics on, e.g. :9477 (disabled if empty)")
+	retryTimeoutPtr := flag.Duration("retry-timeout", 0,
+		"Wall-clock deadline for each of ping/selfRegister/getUuid (0 = unbounded)")
+	logFormatPtr := flag.String("log-format", "text",
+		"File log output format: text or json. Console output is always text.")
+	logTimeKeyPtr := flag.String("log-time-key", "time",
+		"JSON field name for the timestamp when -log-format=json")
+	logLevelKeyPtr := flag.String("log-level-key", "level",
+		"JSON field name for the level when -log-format=json")
 
 	flag.Parse()
 
@@ -91,12 +112,17 @@ func Run() {
 	useStdout := *stdoutPtr
 	noPidFlag := *noPidPtr
 	maxRetries := *maxRetriesPtr
+	generateCert := *generatePtr
+	metricsListen := *metricsListenPtr
+	retryTimeout := *retryTimeoutPtr
+	logFormat := *logFormatPtr
+	logTimeKey := *logTimeKeyPtr
+	logLevelKey := *logLevelKeyPtr
 	args := flag.Args()
 	if versionFlag {
 		fmt.Printf("%s: %s\n", os.Args[0], Version)
 		return
 	}
-	// XXX json to file; text to stdout/console?
 	logf, err := agentlog.Init("client")
 	if err != nil {
 		log.Fatal(err)
@@ -111,8 +137,7 @@ func Run() {
 			log.Fatal(err)
 		}
 	}
-	multi := io.MultiWriter(logf, consolef)
-	log.SetOutput(multi)
+	setupLogging(consolef, logf, logFormat, logTimeKey, logLevelKey)
 	if !noPidFlag {
 		if err := pidfile.CheckAndCreatePidfile(agentName); err != nil {
 			log.Fatal(err)
@@ -141,6 +166,7 @@ func Run() {
 	serverFileName := identityDirname + "/server"
 	uuidFileName := identityDirname + "/uuid"
 	hardwaremodelFileName := identityDirname + "/hardwaremodel"
+	deviceIDFileName := identityDirname + "/deviceid"
 
 	cms := zedcloud.GetCloudMetrics() // Need type of data
 	pub, err := pubsub.Publish(agentName, cms)
@@ -155,6 +181,8 @@ func Run() {
 		oldUUID, err = uuid.FromString(uuidStr)
 		if err != nil {
 			log.Warningf("Malformed UUID file ignored: %s\n", err)
+		} else {
+			sharedLogState.setDeviceUUID(oldUUID.String())
 		}
 	}
 	var oldHardwaremodel string
@@ -163,8 +191,14 @@ func Run() {
 		oldHardwaremodel = strings.TrimSpace(string(b))
 	}
 
+	metrics := newClientMetrics()
+	if metricsListen != "" {
+		metrics.startMetricsServer(metricsListen)
+	}
+
 	clientCtx := clientContext{
 		deviceNetworkStatus: &types.DeviceNetworkStatus{},
+		metrics:             metrics,
 	}
 
 	// Look for global config such as log levels
@@ -236,51 +270,71 @@ func Run() {
 		FailureFunc:         zedcloud.ZedCloudFailure,
 		SuccessFunc:         zedcloud.ZedCloudSuccess,
 	}
-	var onboardCert, deviceCert tls.Certificate
 	var deviceCertPem []byte
 	deviceCertSet := false
-
-	if operations["selfRegister"] ||
-		(operations["ping"] && forceOnboardingCert) {
+	var deviceID devicecert.DeviceID
+	var reloader *certreloader.Reloader
+
+	needDeviceCert := operations["selfRegister"] ||
+		operations["getUuid"] ||
+		(operations["ping"] && !forceOnboardingCert)
+	if needDeviceCert {
+		if generateCert {
+			os.Remove(deviceCertName)
+			os.Remove(deviceKeyName)
+		}
 		var err error
-		onboardCert, err = tls.LoadX509KeyPair(onboardCertName, onboardKeyName)
+		_, deviceID, err = devicecert.EnsureKeyPair(identityDirname,
+			devicecert.CertOpts{CommonName: agentName})
 		if err != nil {
 			log.Fatal(err)
 		}
-		// Load device text cert for upload
-		deviceCertPem, err = ioutil.ReadFile(deviceCertName)
-		if err != nil {
-			log.Fatal(err)
+		deviceCertSet = true
+		log.Infof("Using device id %s\n", deviceID)
+		if operations["selfRegister"] {
+			// zmet.ZRegisterMsg (github.com/zededa/api) has no
+			// field for this yet, so selfRegister cannot send it
+			// and trust-on-first-use pinning by device id is NOT
+			// enforced server-side by this alone; see the
+			// deviceid entry in the file list above.
+			log.Warnf("Device id %s is not sent to the controller "+
+				"(ZRegisterMsg has no field for it yet); only "+
+				"local persistence is done\n", deviceID)
+		}
+		b := []byte(fmt.Sprintf("%s\n", deviceID))
+		if err := ioutil.WriteFile(deviceIDFileName, b, 0644); err != nil {
+			log.Errorln(err)
 		}
 	}
-	if operations["getUuid"] ||
-		(operations["ping"] && !forceOnboardingCert) {
-		// Load device cert
+
+	if operations["selfRegister"] ||
+		(operations["ping"] && forceOnboardingCert) {
+		// Load device text cert for upload. The onboarding cert/key
+		// themselves are loaded by the certreloader below, which is
+		// also the source of the TlsConfig used to send this.
 		var err error
-		deviceCert, err = tls.LoadX509KeyPair(deviceCertName,
-			deviceKeyName)
+		deviceCertPem, err = ioutil.ReadFile(deviceCertName)
 		if err != nil {
 			log.Fatal(err)
 		}
-		deviceCertSet = true
-	}
-
-	server, err := ioutil.ReadFile(serverFileName)
-	if err != nil {
-		log.Fatal(err)
 	}
-	serverNameAndPort := strings.TrimSpace(string(server))
-	serverName := strings.Split(serverNameAndPort, ":")[0]
-	// XXX for local testing
-	// serverNameAndPort = "localhost:9069"
 
 	// Post something without a return type.
 	// Returns true when done; false when retry
-	myPost := func(retryCount int, url string, reqlen int64, b *bytes.Buffer) bool {
+	myPost := func(op string, retryCount int, url string, reqlen int64, b *bytes.Buffer) bool {
+		start := time.Now()
+		zedcloudCtx.TlsConfig = reloader.TLSConfig()
 		resp, contents, err := zedcloud.SendOnAllIntf(zedcloudCtx,
-			serverNameAndPort+url, reqlen, b, retryCount, false)
+			reloader.ServerNameAndPort()+url, reqlen, b, retryCount, false)
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		elapsed := time.Since(start)
+		clientCtx.metrics.recordAttempt(op, statusCode, err, elapsed)
+		entry := log.WithFields(eventFields(op, url, retryCount, statusCode, elapsed))
 		if err != nil {
-			log.Errorln(err)
+			entry.Errorln(err)
 			return false
 		}
 
@@ -291,30 +345,30 @@ func Run() {
 		case http.StatusOK:
 			// Inform ledmanager about existence in cloud
 			types.UpdateLedManagerConfig(4)
-			log.Infof("%s StatusOK\n", url)
+			entry.Infof("%s StatusOK\n", url)
 		case http.StatusCreated:
 			// Inform ledmanager about existence in cloud
 			types.UpdateLedManagerConfig(4)
-			log.Infof("%s StatusCreated\n", url)
+			entry.Infof("%s StatusCreated\n", url)
 		case http.StatusConflict:
 			// Inform ledmanager about brokenness
 			types.UpdateLedManagerConfig(10)
-			log.Errorf("%s StatusConflict\n", url)
+			entry.Errorf("%s StatusConflict\n", url)
 			// Retry until fixed
-			log.Errorf("%s\n", string(contents))
+			entry.Errorf("%s\n", string(contents))
 			return false
 		case http.StatusNotModified: // XXX from zedcloud
 			// Inform ledmanager about brokenness
 			types.UpdateLedManagerConfig(10)
-			log.Errorf("%s StatusNotModified\n", url)
+			entry.Errorf("%s StatusNotModified\n", url)
 			// Retry until fixed
-			log.Errorf("%s\n", string(contents))
+			entry.Errorf("%s\n", string(contents))
 			return false
 		default:
-			log.Errorf("%s statuscode %d %s\n",
+			entry.Errorf("%s statuscode %d %s\n",
 				url, resp.StatusCode,
 				http.StatusText(resp.StatusCode))
-			log.Errorf("%s\n", string(contents))
+			entry.Errorf("%s\n", string(contents))
 			return false
 		}
 
@@ -338,14 +392,10 @@ func Run() {
 		return true
 	}
 
-	// Returns true when done; false when retry
+	// Returns true when done; false when retry. myPost sets
+	// zedcloudCtx.TlsConfig from the certreloader before every send, so
+	// there is no separate TlsConfig setup here.
 	selfRegister := func(retryCount int) bool {
-		tlsConfig, err := zedcloud.GetTlsConfig(serverName, &onboardCert)
-		if err != nil {
-			log.Errorln(err)
-			return false
-		}
-		zedcloudCtx.TlsConfig = tlsConfig
 		registerCreate := &zmet.ZRegisterMsg{
 			PemCert: []byte(base64.StdEncoding.EncodeToString(deviceCertPem)),
 		}
@@ -354,7 +404,7 @@ func Run() {
 			log.Errorln(err)
 			return false
 		}
-		return myPost(retryCount, "/api/v1/edgedevice/register",
+		return myPost("selfRegister", retryCount, "/api/v1/edgedevice/register",
 			int64(len(b)), bytes.NewBuffer(b))
 	}
 
@@ -362,93 +412,78 @@ func Run() {
 	// Returns true when done; false when retry.
 	// Returns the response when done. Caller can not use resp.Body but
 	// can use the contents []byte
-	myGet := func(url string, retryCount int) (bool, *http.Response, []byte) {
+	myGet := func(op, url string, retryCount int) (bool, *http.Response, []byte) {
+		start := time.Now()
+		zedcloudCtx.TlsConfig = reloader.TLSConfig()
 		resp, contents, err := zedcloud.SendOnAllIntf(zedcloudCtx,
-			serverNameAndPort+url, 0, nil, retryCount, false)
+			reloader.ServerNameAndPort()+url, 0, nil, retryCount, false)
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		elapsed := time.Since(start)
+		clientCtx.metrics.recordAttempt(op, statusCode, err, elapsed)
+		entry := log.WithFields(eventFields(op, url, retryCount, statusCode, elapsed))
 		if err != nil {
-			log.Errorln(err)
+			entry.Errorln(err)
 			return false, nil, nil
 		}
 
 		switch resp.StatusCode {
 		case http.StatusOK:
-			log.Infof("%s StatusOK\n", url)
+			entry.Infof("%s StatusOK\n", url)
 			return true, resp, contents
 		default:
-			log.Errorf("%s statuscode %d %s\n",
+			entry.Errorf("%s statuscode %d %s\n",
 				url, resp.StatusCode,
 				http.StatusText(resp.StatusCode))
-			log.Errorf("Received %s\n", string(contents))
+			entry.Errorf("Received %s\n", string(contents))
 			return false, nil, nil
 		}
 	}
 
 	// Setup HTTPS client for deviceCert unless force
-	var cert tls.Certificate
+	activeCertFile, activeKeyFile := deviceCertName, deviceKeyName
 	if forceOnboardingCert || operations["selfRegister"] {
 		log.Infof("Using onboarding cert\n")
-		cert = onboardCert
+		activeCertFile, activeKeyFile = onboardCertName, onboardKeyName
 	} else if deviceCertSet {
 		log.Infof("Using device cert\n")
-		cert = deviceCert
 	} else {
 		log.Fatalf("No device certificate for %v\n", operations)
 	}
-	tlsConfig, err := zedcloud.GetTlsConfig(serverName, &cert)
+
+	// reloader keeps zedcloudCtx.TlsConfig and the server address up to
+	// date as device.cert.pem/device.key.pem/onboard.cert.pem/
+	// onboard.key.pem/root-certificate.pem/server change on disk, so that
+	// cert rotation and controller re-homing do not require a restart.
+	reloader, err = certreloader.New(identityDirname, activeCertFile,
+		activeKeyFile, serverFileName)
 	if err != nil {
 		log.Fatal(err)
 	}
-	zedcloudCtx.TlsConfig = tlsConfig
+	go reloader.Watch()
+	defer reloader.Close()
+	zedcloudCtx.TlsConfig = reloader.TLSConfig()
+
+	backoffPolicy := BackoffPolicy{
+		MaxDelay:    maxDelay,
+		MaxAttempts: maxRetries,
+		Deadline:    retryTimeout,
+	}
 
 	if operations["ping"] {
 		url := "/api/v1/edgedevice/ping"
-		retryCount := 0
-		done := false
-		var delay time.Duration
-		for !done {
-			time.Sleep(delay)
-			done, _, _ = myGet(url, retryCount)
-			if done {
-				continue
-			}
-			retryCount += 1
-			if maxRetries != 0 && retryCount > maxRetries {
-				log.Infof("Exceeded %d retries for ping\n",
-					maxRetries)
-				os.Exit(1)
-			}
-			delay = 2 * (delay + time.Second)
-			if delay > maxDelay {
-				delay = maxDelay
-			}
-			log.Infof("Retrying ping in %d seconds\n",
-				delay/time.Second)
-		}
+		runWithBackoff("ping", backoffPolicy, reloader.ServerChanged(), func(attempt int) bool {
+			done, _, _ := myGet("ping", url, attempt)
+			return done
+		})
 	}
 
 	if operations["selfRegister"] {
-		retryCount := 0
-		done := false
-		var delay time.Duration
-		for !done {
-			time.Sleep(delay)
-			done = selfRegister(retryCount)
-			if done {
-				continue
-			}
-			retryCount += 1
-			if maxRetries != 0 && retryCount > maxRetries {
-				log.Errorf("Exceeded %d retries for selfRegister\n",
-					maxRetries)
-				os.Exit(1)
-			}
-			delay = 2 * (delay + time.Second)
-			if delay > maxDelay {
-				delay = maxDelay
-			}
-			log.Infof("Retrying selfRegister in %d seconds\n",
-				delay/time.Second)
-		}
+		runWithBackoff("selfRegister", backoffPolicy, reloader.ServerChanged(), func(attempt int) bool {
+			return selfRegister(attempt)
+		})
 	}
 
 	if operations["getUuid"] {
@@ -457,15 +492,8 @@ func Run() {
 
 		doWrite := true
 		url := "/api/v1/edgedevice/config"
-		retryCount := 0
-		done := false
-		var delay time.Duration
-		for !done {
-			var resp *http.Response
-			var contents []byte
-
-			time.Sleep(delay)
-			done, resp, contents = myGet(url, retryCount)
+		runWithBackoff("getUuid", backoffPolicy, reloader.ServerChanged(), func(attempt int) bool {
+			done, resp, contents := myGet("getUuid", url, attempt)
 			if done {
 				var err error
 
@@ -473,35 +501,20 @@ func Run() {
 				if err == nil {
 					// Inform ledmanager about config received from cloud
 					types.UpdateLedManagerConfig(4)
-					continue
+					return true
 				}
 				// Keep on trying until it parses
-				done = false
 				log.Errorf("Failed parsing uuid: %s\n",
 					err)
-				continue
+				return false
 			}
-			if oldUUID != nilUUID && retryCount > 2 {
+			if oldUUID != nilUUID && attempt > 2 {
 				log.Infof("Sticking with old UUID\n")
 				devUUID = oldUUID
-				done = true
-				continue
+				return true
 			}
-
-			retryCount += 1
-			if maxRetries != 0 && retryCount > maxRetries {
-				log.Errorf("Exceeded %d retries for getUuid\n",
-					maxRetries)
-				os.Exit(1)
-			}
-			delay = 2 * (delay + time.Second)
-			if delay > maxDelay {
-				delay = maxDelay
-			}
-			log.Infof("Retrying config in %d seconds\n",
-				delay/time.Second)
-
-		}
+			return false
+		})
 		if oldUUID != nilUUID {
 			if oldUUID != devUUID {
 				log.Infof("Replacing existing UUID %s\n",
@@ -521,7 +534,9 @@ func Run() {
 			if err != nil {
 				log.Fatal("WriteFile", err, uuidFileName)
 			}
-			log.Debugf("Wrote UUID %s\n", devUUID)
+			sharedLogState.setDeviceUUID(devUUID.String())
+			log.WithFields(sharedLogState.fields()).Debugf(
+				"Wrote UUID %s\n", devUUID)
 		}
 		doWrite = true
 		if hardwaremodel != "" {
@@ -605,7 +620,10 @@ func handleDNSModify(ctxArg interface{}, key string, statusArg interface{}) {
 			newAddrCount, ctx.usableAddressCount)
 	}
 	ctx.usableAddressCount = newAddrCount
-	log.Infof("handleDNSModify done for %s\n", key)
+	ctx.metrics.setUsableAddresses(newAddrCount)
+	sharedLogState.setUsableAddrs(newAddrCount)
+	log.WithFields(sharedLogState.fields()).Infof(
+		"handleDNSModify done for %s\n", key)
 }
 
 func handleDNSDelete(ctxArg interface{}, key string,
@@ -621,5 +639,8 @@ func handleDNSDelete(ctxArg interface{}, key string,
 	*ctx.deviceNetworkStatus = types.DeviceNetworkStatus{}
 	newAddrCount := types.CountLocalAddrAnyNoLinkLocal(*ctx.deviceNetworkStatus)
 	ctx.usableAddressCount = newAddrCount
-	log.Infof("handleDNSDelete done for %s\n", key)
+	ctx.metrics.setUsableAddresses(newAddrCount)
+	sharedLogState.setUsableAddrs(newAddrCount)
+	log.WithFields(sharedLogState.fields()).Infof(
+		"handleDNSDelete done for %s\n", key)
 }
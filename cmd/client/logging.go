@@ -0,0 +1,113 @@
+// Copyright (c) 2018 Zededa, Inc.
+// All rights reserved.
+
+package client
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// durationMs converts d to whole milliseconds for the *_ms log/metric
+// fields, without relying on time.Duration.Milliseconds (added in Go 1.13).
+func durationMs(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// logState tracks the last-known value of fields that don't originate with
+// a single HTTP round trip (the current backoff delay, the usable address
+// count, the device's UUID once known). fields() merges these into every
+// retry/HTTP log line via eventFields, so a JSON-mode log shipper can join
+// status_code against next_delay_ms/usable_addrs/device_uuid for a single
+// attempt instead of having to correlate three disjoint log lines.
+type logState struct {
+	usableAddrs int64 // atomic
+	nextDelayMs int64 // atomic
+	deviceUUID  atomic.Value
+}
+
+var sharedLogState logState
+
+func (s *logState) setUsableAddrs(n int) {
+	atomic.StoreInt64(&s.usableAddrs, int64(n))
+}
+
+func (s *logState) setNextDelayMs(ms int64) {
+	atomic.StoreInt64(&s.nextDelayMs, ms)
+}
+
+func (s *logState) setDeviceUUID(uuid string) {
+	s.deviceUUID.Store(uuid)
+}
+
+func (s *logState) fields() log.Fields {
+	uuid, _ := s.deviceUUID.Load().(string)
+	return log.Fields{
+		"usable_addrs":  atomic.LoadInt64(&s.usableAddrs),
+		"next_delay_ms": atomic.LoadInt64(&s.nextDelayMs),
+		"device_uuid":   uuid,
+	}
+}
+
+// eventFields builds the full stable set of fields zedclient attaches to
+// a retry/HTTP log line: op, url, attempt, status_code, elapsed_ms, plus
+// whatever of next_delay_ms/usable_addrs/device_uuid is known so far. url
+// and statusCode may be zero-valued for lines that aren't a single HTTP
+// round trip (e.g. the backoff retry log).
+func eventFields(op, url string, attempt, statusCode int, elapsed time.Duration) log.Fields {
+	fields := sharedLogState.fields()
+	fields["op"] = op
+	fields["url"] = url
+	fields["attempt"] = attempt
+	fields["status_code"] = statusCode
+	fields["elapsed_ms"] = durationMs(elapsed)
+	return fields
+}
+
+// logWriterHook forwards every log entry to writer using its own
+// formatter, independent of whatever formatter/output the primary logger
+// is using. This is how the console and file logs are given different
+// formats: the console keeps the primary logger's human-readable text,
+// while the file log can be switched to JSON.
+type logWriterHook struct {
+	writer    io.Writer
+	formatter log.Formatter
+}
+
+func (h *logWriterHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *logWriterHook) Fire(entry *log.Entry) error {
+	b, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = h.writer.Write(b)
+	return err
+}
+
+// setupLogging sends human-readable text to consolef and, per logFormat
+// ("text" or "json"), either the same text or JSON to logf. timestampKey
+// and levelKey rename the corresponding fields when logFormat is "json",
+// so downstream log shippers can be pointed at the fields they expect.
+func setupLogging(consolef, logf io.Writer, logFormat, timestampKey, levelKey string) {
+	log.SetOutput(consolef)
+	log.SetFormatter(&log.TextFormatter{})
+
+	var fileFormatter log.Formatter
+	if logFormat == "json" {
+		fileFormatter = &log.JSONFormatter{
+			FieldMap: log.FieldMap{
+				log.FieldKeyTime:  timestampKey,
+				log.FieldKeyLevel: levelKey,
+			},
+		}
+	} else {
+		fileFormatter = &log.TextFormatter{}
+	}
+	log.AddHook(&logWriterHook{writer: logf, formatter: fileFormatter})
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2018 Zededa, Inc.
+// All rights reserved.
+
+package client
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// clientOps lists the operations zedclient can be invoked with, in the same
+// order as the operations map built in Run. newClientMetrics uses this to
+// pre-initialize per-op gauges so they read 0 rather than being absent from
+// /metrics before an op has ever succeeded.
+var clientOps = []string{"selfRegister", "ping", "getUuid"}
+
+// clientMetrics holds the Prometheus collectors exported by zedclient when
+// -metrics-listen is given. They are registered against a private registry
+// rather than the default one so that importing this package never has the
+// side effect of polluting another process' /metrics.
+type clientMetrics struct {
+	registry          *prometheus.Registry
+	operationAttempts *prometheus.CounterVec
+	operationDuration *prometheus.HistogramVec
+	bootstrapped      *prometheus.GaugeVec
+	usableAddresses   prometheus.Gauge
+	lastSuccess       *prometheus.GaugeVec
+}
+
+func newClientMetrics() *clientMetrics {
+	m := &clientMetrics{
+		registry: prometheus.NewRegistry(),
+		operationAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "zedclient_operation_attempts_total",
+			Help: "Number of ping/selfRegister/getUuid attempts by outcome.",
+		}, []string{"op", "result"}),
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "zedclient_operation_duration_seconds",
+			Help:    "Latency of ping/selfRegister/getUuid HTTP round trips.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"op"}),
+		bootstrapped: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "zedclient_bootstrapped",
+			Help: "1 if the given operation has completed successfully at least once, else 0.",
+		}, []string{"op"}),
+		usableAddresses: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "zedclient_usable_addresses",
+			Help: "Current count of usable local IP addresses from DeviceNetworkStatus.",
+		}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "zedclient_last_success_timestamp_seconds",
+			Help: "Unix timestamp of the last successful attempt, by operation.",
+		}, []string{"op"}),
+	}
+	m.registry.MustRegister(m.operationAttempts, m.operationDuration,
+		m.bootstrapped, m.usableAddresses, m.lastSuccess)
+	for _, op := range clientOps {
+		m.bootstrapped.WithLabelValues(op).Set(0)
+	}
+	return m
+}
+
+// startMetricsServer starts an HTTP server exposing m in Prometheus text
+// format on listenAddr. It runs in its own goroutine; failures are logged
+// but are not fatal since metrics are a best-effort aid to operators.
+func (m *clientMetrics) startMetricsServer(listenAddr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry,
+		promhttp.HandlerOpts{}))
+	go func() {
+		log.Infof("Metrics listening on %s\n", listenAddr)
+		if err := http.ListenAndServe(listenAddr, mux); err != nil {
+			log.Errorf("Metrics server failed: %s\n", err)
+		}
+	}()
+}
+
+// resultLabel classifies an HTTP status code (or a transport-level error
+// when statusCode is 0) into the coarse result label used by
+// zedclient_operation_attempts_total.
+func resultLabel(statusCode int, netErr error) string {
+	switch {
+	case netErr != nil:
+		return "net_err"
+	case statusCode >= 200 && statusCode < 300:
+		return "ok"
+	case statusCode >= 300 && statusCode < 400:
+		// e.g. http.StatusNotModified, which zedclient treats as a
+		// retry-worthy response rather than success -- but it is a
+		// real reply from the server, not a transport failure.
+		return "http_3xx"
+	case statusCode >= 400 && statusCode < 500:
+		return "http_4xx"
+	case statusCode >= 500 && statusCode < 600:
+		return "http_5xx"
+	default:
+		return "net_err"
+	}
+}
+
+// recordAttempt updates the attempts counter and duration histogram for op,
+// and on success bumps bootstrapped/lastSuccess.
+func (m *clientMetrics) recordAttempt(op string, statusCode int, netErr error, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	result := resultLabel(statusCode, netErr)
+	m.operationAttempts.WithLabelValues(op, result).Inc()
+	m.operationDuration.WithLabelValues(op).Observe(elapsed.Seconds())
+	if result == "ok" {
+		m.bootstrapped.WithLabelValues(op).Set(1)
+		m.lastSuccess.WithLabelValues(op).Set(float64(timeNowUnix()))
+	}
+}
+
+func (m *clientMetrics) setUsableAddresses(n int) {
+	if m == nil {
+		return
+	}
+	m.usableAddresses.Set(float64(n))
+}
+
+// timeNowUnix exists so the single call to time.Now().Unix() used for the
+// lastSuccess gauge is easy to find/mock.
+func timeNowUnix() int64 {
+	return time.Now().Unix()
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2018 Zededa, Inc.
+// All rights reserved.
+
+package client
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResultLabel(t *testing.T) {
+	cases := []struct {
+		statusCode int
+		netErr     error
+		want       string
+	}{
+		{200, nil, "ok"},
+		{201, nil, "ok"},
+		{304, nil, "http_3xx"},
+		{404, nil, "http_4xx"},
+		{500, nil, "http_5xx"},
+		{0, errors.New("connection refused"), "net_err"},
+		{0, nil, "net_err"},
+	}
+	for _, c := range cases {
+		got := resultLabel(c.statusCode, c.netErr)
+		if got != c.want {
+			t.Errorf("resultLabel(%d, %v) = %s, want %s",
+				c.statusCode, c.netErr, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2018 Zededa, Inc.
+// All rights reserved.
+
+// Package devicecert generates and loads the device identity keypair and
+// self-signed certificate used by zedclient and any other agent that needs
+// to authenticate to the controller before an operator-provisioned
+// device.cert.pem is available.
+package devicecert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base32"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DeviceID is a stable, human-printable identifier derived from the SHA-256
+// hash of the device's DER-encoded certificate, base32-encoded and grouped
+// with dashes for readability (following the approach Syncthing uses to
+// derive its DeviceID from cert.Certificate[0]).
+type DeviceID string
+
+// KeyType selects the public key algorithm used when generating a new
+// device keypair.
+type KeyType int
+
+const (
+	// KeyTypeECDSA generates a P-256 ECDSA keypair. This is the default.
+	KeyTypeECDSA KeyType = iota
+	// KeyTypeRSA generates a 2048 bit RSA keypair.
+	KeyTypeRSA
+)
+
+// CertOpts controls how a self-signed device certificate is generated.
+type CertOpts struct {
+	KeyType      KeyType
+	Organization string
+	CommonName   string
+	ValidFor     time.Duration // defaults to 10 years if zero
+}
+
+const (
+	certFilename = "device.cert.pem"
+	keyFilename  = "device.key.pem"
+)
+
+// EnsureKeyPair loads the device keypair/certificate from dir if present,
+// and otherwise generates a fresh one and writes it atomically to dir.
+// It returns the usable tls.Certificate along with the DeviceID derived
+// from it.
+func EnsureKeyPair(dir string, opts CertOpts) (tls.Certificate, DeviceID, error) {
+	certFile := filepath.Join(dir, certFilename)
+	keyFile := filepath.Join(dir, keyFilename)
+
+	if _, err := os.Stat(certFile); err == nil {
+		if _, err := os.Stat(keyFile); err == nil {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return tls.Certificate{}, "", fmt.Errorf("EnsureKeyPair: failed to load existing cert/key: %v", err)
+			}
+			id, err := deviceIDFromCert(cert.Certificate[0])
+			if err != nil {
+				return tls.Certificate{}, "", err
+			}
+			return cert, id, nil
+		}
+	}
+	return generateKeyPair(dir, certFile, keyFile, opts)
+}
+
+func generateKeyPair(dir, certFile, keyFile string, opts CertOpts) (tls.Certificate, DeviceID, error) {
+	validFor := opts.ValidFor
+	if validFor == 0 {
+		validFor = 10 * 365 * 24 * time.Hour
+	}
+
+	var priv interface{}
+	var pub interface{}
+	var err error
+	switch opts.KeyType {
+	case KeyTypeRSA:
+		var rsaKey *rsa.PrivateKey
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		priv = rsaKey
+		if rsaKey != nil {
+			pub = &rsaKey.PublicKey
+		}
+	default:
+		var ecKey *ecdsa.PrivateKey
+		ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		priv = ecKey
+		if ecKey != nil {
+			pub = &ecKey.PublicKey
+		}
+	}
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("generateKeyPair: key generation failed: %v", err)
+	}
+
+	serialLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serial, err := rand.Int(rand.Reader, serialLimit)
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("generateKeyPair: serial number generation failed: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{opts.Organization},
+			CommonName:   opts.CommonName,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, pub, priv)
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("generateKeyPair: certificate generation failed: %v", err)
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("generateKeyPair: key marshaling failed: %v", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+
+	if err := writeFileAtomic(dir, certFile, certPem, 0644); err != nil {
+		return tls.Certificate{}, "", err
+	}
+	if err := writeFileAtomic(dir, keyFile, keyPem, 0600); err != nil {
+		return tls.Certificate{}, "", err
+	}
+
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("generateKeyPair: failed to load generated cert/key: %v", err)
+	}
+	id, err := deviceIDFromCert(der)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	return cert, id, nil
+}
+
+// writeFileAtomic writes data to a temp file in dir and renames it into
+// place, so that a crash or power loss mid-write never leaves a partial
+// device.cert.pem/device.key.pem behind.
+func writeFileAtomic(dir, finalName string, data []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(dir, filepath.Base(finalName)+".tmp")
+	if err != nil {
+		return fmt.Errorf("writeFileAtomic: failed to create temp file: %v", err)
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("writeFileAtomic: failed to write %s: %v", tmpName, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("writeFileAtomic: failed to close %s: %v", tmpName, err)
+	}
+	if err := os.Chmod(tmpName, mode); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("writeFileAtomic: failed to chmod %s: %v", tmpName, err)
+	}
+	if err := os.Rename(tmpName, finalName); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("writeFileAtomic: failed to rename %s to %s: %v", tmpName, finalName, err)
+	}
+	return nil
+}
+
+// deviceIDFromCert derives a DeviceID from the SHA-256 digest of a
+// DER-encoded certificate, base32-encoding it and grouping the result with
+// dashes every 7 characters for readability.
+func deviceIDFromCert(der []byte) (DeviceID, error) {
+	if len(der) == 0 {
+		return "", fmt.Errorf("deviceIDFromCert: empty certificate")
+	}
+	sum := sha256.Sum256(der)
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:])
+	var groups []string
+	for i := 0; i < len(encoded); i += 7 {
+		end := i + 7
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		groups = append(groups, encoded[i:end])
+	}
+	return DeviceID(strings.Join(groups, "-")), nil
+}
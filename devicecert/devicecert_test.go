@@ -0,0 +1,78 @@
+// Copyright (c) 2018 Zededa, Inc.
+// All rights reserved.
+
+package devicecert
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEnsureKeyPairGeneratesAndPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devicecert")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := CertOpts{CommonName: "unit-test"}
+	cert, id, err := EnsureKeyPair(dir, opts)
+	if err != nil {
+		t.Fatalf("EnsureKeyPair failed: %v", err)
+	}
+	if id == "" {
+		t.Fatal("EnsureKeyPair returned an empty DeviceID")
+	}
+	if len(cert.Certificate) == 0 {
+		t.Fatal("EnsureKeyPair returned a certificate with no DER bytes")
+	}
+
+	for _, name := range []string{certFilename, keyFilename} {
+		if _, err := os.Stat(dir + "/" + name); err != nil {
+			t.Fatalf("expected %s to exist: %v", name, err)
+		}
+		if leftover, _ := ioutil.ReadDir(dir); len(leftover) > 2 {
+			t.Fatalf("expected only cert/key to remain in %s, found %v", dir, leftover)
+		}
+	}
+
+	// A second call against the same directory must load the persisted
+	// keypair rather than generating a new one.
+	cert2, id2, err := EnsureKeyPair(dir, opts)
+	if err != nil {
+		t.Fatalf("second EnsureKeyPair failed: %v", err)
+	}
+	if id2 != id {
+		t.Fatalf("DeviceID changed across reload: %s != %s", id2, id)
+	}
+	if string(cert2.Certificate[0]) != string(cert.Certificate[0]) {
+		t.Fatal("certificate DER changed across reload")
+	}
+}
+
+func TestDeviceIDFromCert(t *testing.T) {
+	id1, err := deviceIDFromCert([]byte("first-cert-der"))
+	if err != nil {
+		t.Fatalf("deviceIDFromCert failed: %v", err)
+	}
+	id2, err := deviceIDFromCert([]byte("first-cert-der"))
+	if err != nil {
+		t.Fatalf("deviceIDFromCert failed: %v", err)
+	}
+	if id1 != id2 {
+		t.Fatalf("deviceIDFromCert not deterministic: %s != %s", id1, id2)
+	}
+
+	id3, err := deviceIDFromCert([]byte("second-cert-der"))
+	if err != nil {
+		t.Fatalf("deviceIDFromCert failed: %v", err)
+	}
+	if id3 == id1 {
+		t.Fatal("deviceIDFromCert produced the same ID for different input")
+	}
+
+	if _, err := deviceIDFromCert(nil); err == nil {
+		t.Fatal("expected an error for empty DER input")
+	}
+}